@@ -0,0 +1,267 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * Bounded TTL cache for resolved PHIDs, with a background refresher
+ */
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheItem is the value stored in the LRU list
+type cacheItem struct {
+	key       string
+	value     []string
+	negative  bool
+	expiresAt time.Time
+}
+
+// TTLCache is an LRU-bounded cache where entries also expire after a TTL.
+// When a refreshFn is supplied, a background goroutine proactively
+// re-resolves entries that are about to expire, coalescing concurrent
+// refreshes of the same key via singleflightGroup. Failed lookups can be
+// cached negatively under a shorter TTL via StoreNegative, so a bad PHID
+// doesn't hammer phid.query on every request.
+type TTLCache struct {
+	mu           sync.Mutex
+	ll           *list.List
+	items        map[string]*list.Element
+	max          int
+	ttl          time.Duration
+	negativeTTL  time.Duration
+	refreshAhead time.Duration
+	refreshFn    func(key string) ([]string, bool)
+	group        singleflightGroup
+	hits         int64
+	misses       int64
+}
+
+// NewTTLCache builds a cache bounded to max entries (0 = unbounded) with the
+// given TTL and a (typically shorter) negativeTTL for failed lookups. When
+// refreshFn and refreshAhead are both set, entries within refreshAhead of
+// expiring are refreshed in the background instead of going stale.
+func NewTTLCache(max int, ttl time.Duration, negativeTTL time.Duration, refreshAhead time.Duration, refreshFn func(string) ([]string, bool)) *TTLCache {
+	c := &TTLCache{
+		ll:           list.New(),
+		items:        make(map[string]*list.Element),
+		max:          max,
+		ttl:          ttl,
+		negativeTTL:  negativeTTL,
+		refreshAhead: refreshAhead,
+		refreshFn:    refreshFn,
+	}
+	if refreshFn != nil && refreshAhead > 0 {
+		go c.refreshLoop()
+	}
+	return c
+}
+
+// Load returns a cached value if present and not yet expired. A hit
+// includes negatively-cached failures (an empty value), so callers know not
+// to retry a PHID that's already known bad.
+func (c *TTLCache) Load(key string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	item := el.Value.(*cacheItem)
+	if time.Now().After(item.expiresAt) {
+		c.removeElement(el)
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	atomic.AddInt64(&c.hits, 1)
+	return item.value, true
+}
+
+// Store inserts or refreshes a successfully resolved value, evicting the
+// least recently used entry once the cache grows past its max size
+func (c *TTLCache) Store(key string, value []string) {
+	c.store(key, value, false, c.ttl)
+}
+
+// StoreNegative records a failed lookup under the shorter negativeTTL, so a
+// PHID that doesn't resolve isn't re-queried on every request
+func (c *TTLCache) StoreNegative(key string) {
+	c.store(key, nil, true, c.negativeTTL)
+}
+
+func (c *TTLCache) store(key string, value []string, negative bool, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		item := el.Value.(*cacheItem)
+		item.value = value
+		item.negative = negative
+		item.expiresAt = time.Now().Add(ttl)
+		c.ll.MoveToFront(el)
+		return
+	}
+	item := &cacheItem{key: key, value: value, negative: negative, expiresAt: time.Now().Add(ttl)}
+	el := c.ll.PushFront(item)
+	c.items[key] = el
+	if c.max > 0 && c.ll.Len() > c.max {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Stats reports cumulative hit/miss counts, for /metrics
+func (c *TTLCache) Stats() (hits int64, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+// CoalesceBatch resolves a batch of cache-miss keys through the cache's own
+// singleflight group, so N concurrent foreground resolves that reference
+// the same not-yet-cached PHID issue at most one upstream call for it
+// instead of each firing their own
+func (c *TTLCache) CoalesceBatch(keys []string, fn func(claimed []string)) {
+	c.group.DoBatch(keys, fn)
+}
+
+func (c *TTLCache) removeElement(el *list.Element) {
+	if el == nil {
+		return
+	}
+	c.ll.Remove(el)
+	item := el.Value.(*cacheItem)
+	delete(c.items, item.key)
+}
+
+// Flush discards every cached entry
+func (c *TTLCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// Len reports the current entry count, for admin inspection
+func (c *TTLCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Snapshot copies out the current cache contents, for admin inspection
+func (c *TTLCache) Snapshot() map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string][]string, len(c.items))
+	for k, el := range c.items {
+		out[k] = el.Value.(*cacheItem).value
+	}
+	return out
+}
+
+// refreshLoop periodically scans for entries nearing expiry and resolves
+// them ahead of time so callers never observe a cold cache on a rename.
+// Negatively-cached entries are left alone here: they exist specifically
+// to stop a bad PHID from being re-queried, and a short negativeTTL would
+// otherwise sit inside the refresh-ahead window for its entire lifetime.
+func (c *TTLCache) refreshLoop() {
+	interval := c.refreshAhead / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		c.mu.Lock()
+		var due []string
+		now := time.Now()
+		for k, el := range c.items {
+			item := el.Value.(*cacheItem)
+			if item.negative {
+				continue
+			}
+			if item.expiresAt.Sub(now) <= c.refreshAhead {
+				due = append(due, k)
+			}
+		}
+		c.mu.Unlock()
+		for _, k := range due {
+			c.group.Do(k, func() {
+				if value, ok := c.refreshFn(k); ok {
+					c.Store(k, value)
+				}
+			})
+		}
+	}
+}
+
+// singleflightGroup coalesces concurrent calls for the same key down to one
+type singleflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*sync.WaitGroup
+}
+
+func (g *singleflightGroup) Do(key string, fn func()) {
+	g.mu.Lock()
+	if wg, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		wg.Wait()
+		return
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	if g.calls == nil {
+		g.calls = make(map[string]*sync.WaitGroup)
+	}
+	g.calls[key] = wg
+	g.mu.Unlock()
+
+	fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	wg.Done()
+}
+
+// DoBatch claims whichever of keys no other caller is already resolving,
+// invokes fn once with just those claimed keys, and blocks on the rest
+// until whichever caller claimed them finishes. This lets a batch fetch
+// stay a single call per request while still coalescing the same key
+// across concurrent requests down to one in-flight resolution.
+func (g *singleflightGroup) DoBatch(keys []string, fn func(claimed []string)) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*sync.WaitGroup)
+	}
+	var claimed []string
+	var claimedWGs []*sync.WaitGroup
+	var waitOn []*sync.WaitGroup
+	for _, k := range keys {
+		if wg, ok := g.calls[k]; ok {
+			waitOn = append(waitOn, wg)
+			continue
+		}
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		g.calls[k] = wg
+		claimed = append(claimed, k)
+		claimedWGs = append(claimedWGs, wg)
+	}
+	g.mu.Unlock()
+
+	if len(claimed) > 0 {
+		fn(claimed)
+		g.mu.Lock()
+		for _, k := range claimed {
+			delete(g.calls, k)
+		}
+		g.mu.Unlock()
+		for _, wg := range claimedWGs {
+			wg.Done()
+		}
+	}
+	for _, wg := range waitOn {
+		wg.Wait()
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * Tests for singleflight coalescing and the negative-cache refresh exclusion
+ */
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSingleflightDoCoalesces checks that a second Do for a key already
+// in flight waits for, rather than duplicates, the first call's fn.
+func TestSingleflightDoCoalesces(t *testing.T) {
+	var g singleflightGroup
+	var calls int32
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g.Do("k", func() {
+			atomic.AddInt32(&calls, 1)
+			<-block
+		})
+	}()
+	time.Sleep(20 * time.Millisecond) // let the first call claim the key
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g.Do("k", func() {
+			atomic.AddInt32(&calls, 1)
+		})
+	}()
+	time.Sleep(20 * time.Millisecond) // let the second call start waiting
+	close(block)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected fn to run once for a coalesced key, ran %d times", got)
+	}
+}
+
+// TestSingleflightDoBatchExcludesAlreadyClaimedKeys checks that a key another
+// caller is already resolving isn't handed to a second DoBatch's fn, only
+// waited on.
+func TestSingleflightDoBatchExcludesAlreadyClaimedKeys(t *testing.T) {
+	var g singleflightGroup
+	var calls int32
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	var secondClaimed []string
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g.DoBatch([]string{"a", "b"}, func(claimed []string) {
+			atomic.AddInt32(&calls, 1)
+			<-block
+		})
+	}()
+	time.Sleep(20 * time.Millisecond) // let the first call claim "a" and "b"
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g.DoBatch([]string{"b", "c"}, func(claimed []string) {
+			atomic.AddInt32(&calls, 1)
+			secondClaimed = append([]string(nil), claimed...)
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(block)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("expected one fn invocation per caller, got %d", got)
+	}
+	for _, k := range secondClaimed {
+		if k == "b" {
+			t.Fatalf("second caller claimed %q, which the first caller already owned", k)
+		}
+	}
+}
+
+// TestRefreshLoopSkipsNegativeEntries checks that a negatively-cached entry
+// is never handed to refreshFn, even while it sits inside the refresh-ahead
+// window for its whole (short) negativeTTL lifetime.
+func TestRefreshLoopSkipsNegativeEntries(t *testing.T) {
+	var refreshed int32
+	c := NewTTLCache(0, time.Hour, 30*time.Millisecond, 200*time.Millisecond, func(key string) ([]string, bool) {
+		atomic.AddInt32(&refreshed, 1)
+		return []string{"x"}, true
+	})
+	c.StoreNegative("bad-phid")
+	time.Sleep(350 * time.Millisecond)
+	if got := atomic.LoadInt32(&refreshed); got != 0 {
+		t.Fatalf("refreshFn should never be called for a negatively-cached entry, called %d times", got)
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * CLI flags, -config file loading and subcommands (serve/version/validate-config/resolve)
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// cliSettings mirrors every SYNAPSE_* setting this tool reads, merged from
+// (in increasing precedence) the environment, -config path.yaml, and flags
+type cliSettings struct {
+	phabURL      string
+	apiToken     string
+	feedRoom     string
+	host         string
+	conduitToken string
+	debug        string
+	resolve      string
+	lookupPhid   string
+	logDir       string
+	logConfig    string
+	logLevel     string
+	backends     string
+	bind         string
+	roomRoutes   map[string]string
+}
+
+// fileConfig is the shape accepted by -config path.yaml: a flat settings
+// block plus a per-room routing table used to resolve tagged stories
+type fileConfig struct {
+	settings map[string]string
+	rooms    map[string]string
+}
+
+// loadYAMLConfig parses the small flat-map-plus-one-nested-block subset of
+// YAML this tool needs (top-level "key: value" lines, plus an indented
+// "rooms:" block of "tag: room-id" pairs), rather than pulling in a YAML
+// library this repo doesn't vendor
+func loadYAMLConfig(path string) (*fileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg := &fileConfig{settings: make(map[string]string), rooms: make(map[string]string)}
+	inRooms := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			inRooms = trimmed == "rooms:"
+			if inRooms {
+				continue
+			}
+		}
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+		if inRooms {
+			cfg.rooms[key] = value
+		} else {
+			cfg.settings[key] = value
+		}
+	}
+	return cfg, scanner.Err()
+}
+
+// settingsFlagSet declares every flag the serve/resolve/validate-config
+// subcommands accept, each defaulting to its SYNAPSE_* environment
+// variable so existing deployments keep working untouched with no flags
+func settingsFlagSet(name string) (*flag.FlagSet, *cliSettings) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	s := &cliSettings{}
+	fs.String("config", "", "path to a YAML config file (flags and env vars still take precedence)")
+	fs.StringVar(&s.bind, "bind", ":8080", "address to bind the HTTP server to")
+	fs.StringVar(&s.phabURL, "phab-url", os.Getenv(PhabUrlKey), "base URL of the Phabricator instance")
+	fs.StringVar(&s.apiToken, "api-token", os.Getenv(ApiTokenKey), "Synapse access token used to post to Matrix")
+	fs.StringVar(&s.feedRoom, "feed-room", os.Getenv(FeedRoomKey), "default Matrix room ID to post stories to")
+	fs.StringVar(&s.host, "host", os.Getenv(HostKey), "base URL of the Synapse homeserver")
+	fs.StringVar(&s.conduitToken, "conduit-token", os.Getenv(ConduitKey), "Phabricator Conduit API token")
+	fs.StringVar(&s.debug, "debug", os.Getenv(DebugKey), "enable debug-level logging (true/false)")
+	fs.StringVar(&s.resolve, "resolve", os.Getenv(ResolveKey), "comma-separated PHID prefixes to resolve")
+	fs.StringVar(&s.lookupPhid, "lookup-phid", os.Getenv(LookupsKey), "PHID of the paste holding lookup aliases")
+	fs.StringVar(&s.logDir, "log-dir", os.Getenv(LogFileDir), "directory for logs and the outbox")
+	fs.StringVar(&s.logConfig, "log-config", os.Getenv(LogConfigKey), "JSON array of log adapter configs")
+	fs.StringVar(&s.logLevel, "log-level", os.Getenv(LogLevelKey), "minimum level to log: debug, info, warn or error (default debug)")
+	fs.StringVar(&s.backends, "backends", os.Getenv(BackendsKey), "comma-separated notifier backends to enable")
+	return fs, s
+}
+
+// parseSettings parses args against fs/s, then overlays any -config file
+// onto the settings a flag wasn't explicitly passed for, so precedence
+// ends up flag > config file > environment
+func parseSettings(fs *flag.FlagSet, s *cliSettings, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	s.roomRoutes = make(map[string]string)
+	configPath := fs.Lookup("config").Value.String()
+	if configPath == "" {
+		return nil
+	}
+	fc, err := loadYAMLConfig(configPath)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	overlay := func(flagName string, dst *string) {
+		if set[flagName] {
+			return
+		}
+		if v, ok := fc.settings[flagName]; ok {
+			*dst = v
+		}
+	}
+	overlay("phab-url", &s.phabURL)
+	overlay("api-token", &s.apiToken)
+	overlay("feed-room", &s.feedRoom)
+	overlay("host", &s.host)
+	overlay("conduit-token", &s.conduitToken)
+	overlay("debug", &s.debug)
+	overlay("resolve", &s.resolve)
+	overlay("lookup-phid", &s.lookupPhid)
+	overlay("log-dir", &s.logDir)
+	overlay("log-config", &s.logConfig)
+	overlay("log-level", &s.logLevel)
+	overlay("backends", &s.backends)
+	overlay("bind", &s.bind)
+	s.roomRoutes = fc.rooms
+	return nil
+}
+
+// validateSettings reports every required field still empty once flags,
+// -config and the environment have all been applied, instead of letting
+// main silently build a broken URL like "api/phid.query"
+func validateSettings(s *cliSettings) []string {
+	var missing []string
+	if s.phabURL == "" {
+		missing = append(missing, PhabUrlKey)
+	}
+	if s.apiToken == "" {
+		missing = append(missing, ApiTokenKey)
+	}
+	if s.feedRoom == "" {
+		missing = append(missing, FeedRoomKey)
+	}
+	if s.conduitToken == "" {
+		missing = append(missing, ConduitKey)
+	}
+	return missing
+}
+
+// usageErrorf reports a CLI usage error in the style of Kythe's
+// flagutil.UsageErrorf: print the message and the subcommand's usage to
+// stderr, then exit non-zero, rather than proceeding with a half-valid config
+func usageErrorf(fs *flag.FlagSet, format string, args ...interface{}) {
+	fmt.Fprintln(os.Stderr, fmt.Sprintf(format, args...))
+	fs.Usage()
+	os.Exit(2)
+}
+
+// main-entry point; dispatches to the serve/version/validate-config/resolve
+// subcommands, defaulting to serve when the first argument looks like a flag
+func main() {
+	args := os.Args[1:]
+	sub := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub = args[0]
+		args = args[1:]
+	}
+	switch sub {
+	case "version":
+		fmt.Println(Version)
+	case "validate-config":
+		runValidateConfig(args)
+	case "resolve":
+		runResolve(args)
+	case "serve":
+		runServe(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown subcommand %q (want serve, version, validate-config, resolve)\n", sub)
+		os.Exit(2)
+	}
+}
+
+// runValidateConfig merges settings the same way serve would, reports any
+// missing required fields, and exits without starting a server
+func runValidateConfig(args []string) {
+	fs, s := settingsFlagSet("validate-config")
+	if err := parseSettings(fs, s, args); err != nil {
+		usageErrorf(fs, "%s", err)
+	}
+	if missing := validateSettings(s); len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "missing required settings: %s\n", strings.Join(missing, ", "))
+		os.Exit(1)
+	}
+	fmt.Println("config OK")
+}
+
+// runResolve merges settings the same way serve would, then resolves a
+// single PHID against Conduit and prints the result, letting an operator
+// debug a lookup without standing up the HTTP server. Built with live set
+// to false, so it can't re-post previously-failed outbox deliveries or
+// make a live paste lookup just from a one-off PHID resolve.
+func runResolve(args []string) {
+	fs, s := settingsFlagSet("resolve")
+	if err := parseSettings(fs, s, args); err != nil {
+		usageErrorf(fs, "%s", err)
+	}
+	if fs.NArg() != 1 {
+		usageErrorf(fs, "resolve requires exactly one PHID argument")
+	}
+	if missing := validateSettings(s); len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "missing required settings: %s\n", strings.Join(missing, ", "))
+		os.Exit(1)
+	}
+	conf := buildConfig(s, false)
+	for _, result := range resolvePHIDs(context.Background(), []string{fs.Arg(0)}, conf) {
+		fmt.Println(result)
+	}
+}
+
+// runServe merges settings, validates them, registers the HTTP handlers and
+// blocks serving until shutdown
+func runServe(args []string) {
+	fs, s := settingsFlagSet("serve")
+	if err := parseSettings(fs, s, args); err != nil {
+		usageErrorf(fs, "%s", err)
+	}
+	if missing := validateSettings(s); len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "missing required settings: %s\n", strings.Join(missing, ", "))
+		os.Exit(1)
+	}
+	conf := buildConfig(s, true)
+	registerHandlers(conf, fmt.Sprintf("version: %s", Version))
+	conf.logger.Info("started")
+	grace := time.Duration(envInt(ShutdownGraceKey, DefaultShutdownGrace)) * time.Second
+	if err := serve(conf, s.bind, grace); err != nil {
+		conf.logger.Error("listen failure", err)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * Shared HTTP client with deadlines, connection reuse and retry-with-backoff
+ */
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Retry tuning for idempotent posts against Conduit/chat backends
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryFactor    = 2
+	retryCapDelay  = 30 * time.Second
+)
+
+// newHTTPClient builds a client tuned for repeated Conduit/Matrix calls:
+// a bounded, reused idle connection pool and a fixed per-request timeout
+func newHTTPClient(timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+// doWithRetry executes req against client, retrying network errors and
+// 5xx/429 responses with exponential backoff and jitter. req.GetBody must
+// be set so the body can be replayed across attempts. A 429 with a
+// Retry-After header overrides the computed backoff for that attempt.
+func doWithRetry(ctx context.Context, client *http.Client, req *http.Request, attempts int) (*http.Response, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var resp *http.Response
+	var err error
+	delay := retryBaseDelay
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, berr := req.GetBody()
+			if berr == nil {
+				req.Body = body
+			}
+		}
+		resp, err = client.Do(req.WithContext(ctx))
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		wait := delay
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			if ra := resp.Header.Get("Retry-After"); ra != "" {
+				if secs, perr := strconv.Atoi(ra); perr == nil {
+					wait = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		if attempt == attempts-1 {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		jittered := wait/2 + time.Duration(rand.Int63n(int64(wait/2+1)))
+		select {
+		case <-time.After(jittered):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= retryFactor
+		if delay > retryCapDelay {
+			delay = retryCapDelay
+		}
+	}
+	return resp, err
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * Tests for doWithRetry's backoff and final-attempt response handling
+ */
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// TestDoWithRetryLeavesFinalResponseBodyOpen checks that the response
+// returned after exhausting every retry attempt still has a readable body,
+// since an earlier version closed it before returning.
+func TestDoWithRetryLeavesFinalResponseBodyOpen(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("boom"))
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+
+	resp, err := doWithRetry(context.Background(), srv.Client(), req, 2)
+	if err != nil {
+		t.Fatalf("doWithRetry returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the final attempt's response body failed (likely already closed): %v", err)
+	}
+	if string(body) != "boom" {
+		t.Fatalf("got body %q, want %q", body, "boom")
+	}
+}
+
+// TestDoWithRetryStopsOnSuccess checks that a 2xx response is returned
+// immediately without burning through the remaining retry attempts.
+func TestDoWithRetryStopsOnSuccess(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+
+	resp, err := doWithRetry(context.Background(), srv.Client(), req, 5)
+	if err != nil {
+		t.Fatalf("doWithRetry returned error: %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("expected exactly one request for an immediate 2xx, got %d", got)
+	}
+}
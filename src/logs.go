@@ -0,0 +1,527 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * Pluggable, leveled log sinks (inspired by the Beego/gr-logs multi-adapter logger)
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log level emitted to every adapter
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// parseLevel maps a SYNAPSE_LOG_LEVEL value to a Level, defaulting to
+// LevelDebug (letting everything through) when name is empty or unknown so
+// existing deployments that don't set it keep today's behavior
+func parseLevel(name string) Level {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug
+	case "info":
+		return LevelInfo
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	}
+	return LevelDebug
+}
+
+// Adapter is a single log sink; Init receives its own JSON config block
+type Adapter interface {
+	Init(config string) error
+	WriteMsg(when time.Time, msg string, level Level) error
+	Flush()
+}
+
+// adapterFactories is the registry of known adapter constructors
+var adapterFactories = map[string]func() Adapter{}
+
+// RegisterAdapter makes an adapter available to SYNAPSE_LOG_CONFIG by name
+func RegisterAdapter(name string, factory func() Adapter) {
+	adapterFactories[name] = factory
+}
+
+func init() {
+	RegisterAdapter("file", func() Adapter { return &fileAdapter{} })
+	RegisterAdapter("syslog", func() Adapter { return &syslogAdapter{} })
+	RegisterAdapter("elasticsearch", func() Adapter { return &esAdapter{} })
+	RegisterAdapter("alils", func() Adapter { return &aliLSAdapter{} })
+}
+
+// adapterConfig is one entry of the SYNAPSE_LOG_CONFIG JSON array
+type adapterConfig struct {
+	Adapter string `json:"adapter"`
+	Config  string `json:"config"`
+}
+
+// logQueueSize bounds the number of records buffered ahead of the single
+// writer goroutine before a caller blocks
+const logQueueSize = 1024
+
+// logEntry is one record queued up for the writer goroutine
+type logEntry struct {
+	when  time.Time
+	level Level
+	msg   string
+}
+
+// Logger queues every message through a buffered channel and fans it out to
+// all configured adapters from a single writer goroutine, so a burst of
+// concurrent callers (e.g. one per resolved PHID) never races the adapters
+// or opens/closes a file per write. Records below minLevel are dropped
+// before they're ever queued, so operators can turn down verbosity (e.g.
+// to stop Debug/Info chatter reaching a network-backed adapter like
+// Elasticsearch) without editing code.
+type Logger struct {
+	adapters []Adapter
+	minLevel Level
+	queue    chan logEntry
+	flushReq chan chan struct{}
+}
+
+// NewLogger builds a Logger from a SYNAPSE_LOG_CONFIG JSON array; when unset
+// it falls back to a single rotating file adapter rooted at logDir so
+// existing deployments keep working untouched. Only records at or above
+// minLevel reach any adapter.
+func NewLogger(rawConfig string, logDir string, minLevel Level) *Logger {
+	logger := &Logger{minLevel: minLevel}
+	var configs []adapterConfig
+	if rawConfig != "" {
+		if err := json.Unmarshal([]byte(rawConfig), &configs); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid "+LogConfigKey+": "+err.Error())
+		}
+	}
+	if len(configs) == 0 {
+		defaultConfig, _ := json.Marshal(map[string]string{"filename": path.Join(logDir, "phab-http.log")})
+		configs = []adapterConfig{{Adapter: "file", Config: string(defaultConfig)}}
+	}
+	for _, c := range configs {
+		factory, ok := adapterFactories[c.Adapter]
+		if !ok {
+			fmt.Fprintln(os.Stderr, "unknown log adapter: "+c.Adapter)
+			continue
+		}
+		a := factory()
+		if err := a.Init(c.Config); err != nil {
+			fmt.Fprintln(os.Stderr, "log adapter init failed ("+c.Adapter+"): "+err.Error())
+			continue
+		}
+		logger.adapters = append(logger.adapters, a)
+	}
+	logger.queue = make(chan logEntry, logQueueSize)
+	logger.flushReq = make(chan chan struct{})
+	go logger.run()
+	return logger
+}
+
+// run is the single writer goroutine; it owns every adapter so concurrent
+// Debug/Info/Warn/Error callers never race a WriteMsg call
+func (l *Logger) run() {
+	for {
+		select {
+		case e := <-l.queue:
+			l.dispatch(e)
+		case done := <-l.flushReq:
+			draining := true
+			for draining {
+				select {
+				case e := <-l.queue:
+					l.dispatch(e)
+				default:
+					draining = false
+				}
+			}
+			for _, a := range l.adapters {
+				a.Flush()
+			}
+			close(done)
+		}
+	}
+}
+
+func (l *Logger) dispatch(e logEntry) {
+	for _, a := range l.adapters {
+		a.WriteMsg(e.when, e.msg, e.level)
+	}
+}
+
+func (l *Logger) write(level Level, msg string, args []string) {
+	if level < l.minLevel {
+		return
+	}
+	if len(args) > 0 {
+		msg = strings.Join(append([]string{msg}, args...), " ")
+	}
+	l.queue <- logEntry{when: time.Now(), level: level, msg: msg}
+}
+
+// Debug records a debug-level message across every adapter
+func (l *Logger) Debug(msg string, args ...string) {
+	l.write(LevelDebug, msg, args)
+}
+
+// Info records an info-level message across every adapter
+func (l *Logger) Info(msg string, args ...string) {
+	l.write(LevelInfo, msg, args)
+}
+
+// Warn records a warn-level message across every adapter
+func (l *Logger) Warn(msg string, args ...string) {
+	l.write(LevelWarn, msg, args)
+}
+
+// Error records an error-level message, appending err's text when present
+func (l *Logger) Error(msg string, err error) {
+	if err != nil {
+		msg = msg + ": " + err.Error()
+	}
+	l.write(LevelError, msg, nil)
+}
+
+// Flush drains any records still queued, then asks every adapter to push
+// out its own buffered records, blocking until both have completed
+func (l *Logger) Flush() {
+	done := make(chan struct{})
+	l.flushReq <- done
+	<-done
+}
+
+// fileFields is the JSON config block accepted by the file adapter
+type fileFields struct {
+	Filename string `json:"filename"`
+	MaxSize  int64  `json:"maxsize"`
+	MaxFiles int    `json:"maxfiles"`
+}
+
+// fileAdapter writes to a single file, rotating by day or by size
+type fileAdapter struct {
+	sync.Mutex
+	fileFields
+	file    *os.File
+	openDay string
+	size    int64
+}
+
+func (f *fileAdapter) Init(config string) error {
+	if err := json.Unmarshal([]byte(config), &f.fileFields); err != nil {
+		return err
+	}
+	if f.Filename == "" {
+		return fmt.Errorf("file adapter requires a filename")
+	}
+	if f.MaxFiles == 0 {
+		f.MaxFiles = 7
+	}
+	return nil
+}
+
+func (f *fileAdapter) WriteMsg(when time.Time, msg string, level Level) error {
+	f.Lock()
+	defer f.Unlock()
+	day := when.Format("2006-01-02")
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	if day != f.openDay || (f.MaxSize > 0 && f.size >= f.MaxSize) {
+		f.rotate(when)
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(logRecord{When: when, Level: level.String(), Msg: msg})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+func (f *fileAdapter) open() error {
+	file, err := os.OpenFile(f.Filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, statErr := file.Stat()
+	f.file = file
+	f.openDay = time.Now().Format("2006-01-02")
+	f.size = 0
+	if statErr == nil {
+		f.size = info.Size()
+	}
+	return nil
+}
+
+func (f *fileAdapter) rotate(when time.Time) {
+	f.file.Close()
+	rotated := fmt.Sprintf("%s.%s", f.Filename, when.Format("2006-01-02-150405"))
+	os.Rename(f.Filename, rotated)
+	f.file = nil
+	f.size = 0
+	f.pruneOld()
+}
+
+// pruneOld keeps only the MaxFiles most recent rotated logs on disk
+func (f *fileAdapter) pruneOld() {
+	dir := path.Dir(f.Filename)
+	base := path.Base(f.Filename)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), base+".") {
+			rotated = append(rotated, path.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(rotated)
+	for len(rotated) > f.MaxFiles {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+func (f *fileAdapter) Flush() {}
+
+// syslogFields is the JSON config block accepted by the syslog adapter
+type syslogFields struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	Tag     string `json:"tag"`
+}
+
+// syslogAdapter forwards records to the local or a remote syslog daemon
+type syslogAdapter struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogAdapter) Init(config string) error {
+	var f syslogFields
+	if config != "" {
+		if err := json.Unmarshal([]byte(config), &f); err != nil {
+			return err
+		}
+	}
+	if f.Tag == "" {
+		f.Tag = "phab-http"
+	}
+	var w *syslog.Writer
+	var err error
+	if f.Network != "" && f.Addr != "" {
+		w, err = syslog.Dial(f.Network, f.Addr, syslog.LOG_INFO, f.Tag)
+	} else {
+		w, err = syslog.New(syslog.LOG_INFO, f.Tag)
+	}
+	if err != nil {
+		return err
+	}
+	s.writer = w
+	return nil
+}
+
+func (s *syslogAdapter) WriteMsg(when time.Time, msg string, level Level) error {
+	switch level {
+	case LevelDebug:
+		return s.writer.Debug(msg)
+	case LevelInfo:
+		return s.writer.Info(msg)
+	case LevelWarn:
+		return s.writer.Warning(msg)
+	default:
+		return s.writer.Err(msg)
+	}
+}
+
+func (s *syslogAdapter) Flush() {}
+
+// logRecord is the JSON shape shared by the batched adapters
+type logRecord struct {
+	When  time.Time `json:"when"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+}
+
+// esFields is the JSON config block accepted by the Elasticsearch adapter
+type esFields struct {
+	URL       string `json:"url"`
+	Index     string `json:"index"`
+	BatchSize int    `json:"batchSize"`
+	FlushWhen string `json:"flushWhen"`
+}
+
+// esAdapter bulk-indexes buffered records into Elasticsearch
+type esAdapter struct {
+	sync.Mutex
+	esFields
+	buf []logRecord
+}
+
+func (e *esAdapter) Init(config string) error {
+	if err := json.Unmarshal([]byte(config), &e.esFields); err != nil {
+		return err
+	}
+	if e.URL == "" || e.Index == "" {
+		return fmt.Errorf("elasticsearch adapter requires url and index")
+	}
+	if e.BatchSize == 0 {
+		e.BatchSize = 50
+	}
+	flush := 5 * time.Second
+	if e.FlushWhen != "" {
+		if d, err := time.ParseDuration(e.FlushWhen); err == nil {
+			flush = d
+		}
+	}
+	go func() {
+		for range time.Tick(flush) {
+			e.Flush()
+		}
+	}()
+	return nil
+}
+
+func (e *esAdapter) WriteMsg(when time.Time, msg string, level Level) error {
+	e.Lock()
+	e.buf = append(e.buf, logRecord{When: when, Level: level.String(), Msg: msg})
+	full := len(e.buf) >= e.BatchSize
+	e.Unlock()
+	if full {
+		e.Flush()
+	}
+	return nil
+}
+
+func (e *esAdapter) Flush() {
+	e.Lock()
+	batch := e.buf
+	e.buf = nil
+	e.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	var body bytes.Buffer
+	for _, r := range batch {
+		fmt.Fprintf(&body, "{\"index\":{\"_index\":%q}}\n", e.Index)
+		b, _ := json.Marshal(r)
+		body.Write(b)
+		body.WriteString("\n")
+	}
+	resp, err := http.Post(strings.TrimRight(e.URL, "/")+"/_bulk", "application/x-ndjson", &body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "elasticsearch log flush failed: "+err.Error())
+		return
+	}
+	resp.Body.Close()
+}
+
+// aliLSFields is the JSON config block accepted by the Ali LogService adapter
+type aliLSFields struct {
+	Endpoint  string `json:"endpoint"`
+	Project   string `json:"project"`
+	Logstore  string `json:"logstore"`
+	BatchSize int    `json:"batchSize"`
+	FlushWhen string `json:"flushWhen"`
+}
+
+// aliLSAdapter batches records and pushes them to an Ali LogService-style
+// HTTP endpoint, flushing on count or on a timed interval
+type aliLSAdapter struct {
+	sync.Mutex
+	aliLSFields
+	buf []logRecord
+}
+
+func (a *aliLSAdapter) Init(config string) error {
+	if err := json.Unmarshal([]byte(config), &a.aliLSFields); err != nil {
+		return err
+	}
+	if a.Endpoint == "" || a.Project == "" || a.Logstore == "" {
+		return fmt.Errorf("alils adapter requires endpoint, project and logstore")
+	}
+	if a.BatchSize == 0 {
+		a.BatchSize = 100
+	}
+	flush := 10 * time.Second
+	if a.FlushWhen != "" {
+		if d, err := time.ParseDuration(a.FlushWhen); err == nil {
+			flush = d
+		}
+	}
+	go func() {
+		for range time.Tick(flush) {
+			a.Flush()
+		}
+	}()
+	return nil
+}
+
+func (a *aliLSAdapter) WriteMsg(when time.Time, msg string, level Level) error {
+	a.Lock()
+	a.buf = append(a.buf, logRecord{When: when, Level: level.String(), Msg: msg})
+	full := len(a.buf) >= a.BatchSize
+	a.Unlock()
+	if full {
+		a.Flush()
+	}
+	return nil
+}
+
+func (a *aliLSAdapter) Flush() {
+	a.Lock()
+	batch := a.buf
+	a.buf = nil
+	a.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	b, err := json.Marshal(batch)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "alils log flush failed: "+err.Error())
+		return
+	}
+	url := fmt.Sprintf("%s/logstores/%s/shards/lb", strings.TrimRight(a.Endpoint, "/"), a.Logstore)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "alils log flush failed: "+err.Error())
+		return
+	}
+	resp.Body.Close()
+}
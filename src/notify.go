@@ -0,0 +1,226 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * Notifier backends for posting stories to chat systems
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Backend names accepted in SYNAPSE_BACKENDS
+const (
+	BackendMatrix     = "matrix"
+	BackendSlack      = "slack"
+	BackendTeams      = "teams"
+	BackendWebhook    = "webhook"
+	BackendDiscord    = "discord"
+	BackendMattermost = "mattermost"
+)
+
+// Notifier posts a story out to a single chat backend
+type Notifier interface {
+	// Name is the backend name this notifier was built for (one of the
+	// Backend* constants), used to record which notifier(s) an outbox
+	// entry needs redelivering to
+	Name() string
+	Send(ctx context.Context, text string, refs []string, routingKey string) error
+}
+
+// Build the notifier set selected by SYNAPSE_BACKENDS (defaults to matrix)
+func buildNotifiers(conf *Config) []Notifier {
+	names := strings.Split(os.Getenv(BackendsKey), ",")
+	var notifiers []Notifier
+	for _, name := range names {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch name {
+		case BackendMatrix:
+			notifiers = append(notifiers, &MatrixNotifier{conf: conf})
+		case BackendSlack:
+			if hook := os.Getenv(SlackWebhookKey); hook != "" {
+				notifiers = append(notifiers, &SlackNotifier{webhook: hook, conf: conf})
+			}
+		case BackendTeams:
+			if hook := os.Getenv(TeamsWebhookKey); hook != "" {
+				notifiers = append(notifiers, &TeamsNotifier{webhook: hook, conf: conf})
+			}
+		case BackendWebhook:
+			if hook := os.Getenv(WebhookUrlKey); hook != "" {
+				notifiers = append(notifiers, &WebhookNotifier{url: hook, conf: conf})
+			}
+		case BackendDiscord:
+			if hook := os.Getenv(DiscordWebhookKey); hook != "" {
+				notifiers = append(notifiers, &DiscordNotifier{webhook: hook, conf: conf})
+			}
+		case BackendMattermost:
+			if hook := os.Getenv(MattermostWebhookKey); hook != "" {
+				notifiers = append(notifiers, &MattermostNotifier{webhook: hook, conf: conf})
+			}
+		case "":
+			continue
+		default:
+			conf.logger.Warn("unknown notifier backend: " + name)
+		}
+	}
+	if len(notifiers) == 0 {
+		notifiers = append(notifiers, &MatrixNotifier{conf: conf})
+	}
+	return notifiers
+}
+
+// postJSONBody marshals and POSTs a JSON payload through conf's shared,
+// retrying HTTP client, reporting any failure
+func postJSONBody(ctx context.Context, conf *Config, url string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := doWithRetry(ctx, conf.httpClient, req, conf.httpRetries)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// formatRefs renders the trailing "(references: ...)" suffix shared by backends
+func formatRefs(text string, refs []string) string {
+	if len(refs) > 0 {
+		return text + " (references: " + strings.Join(refs, ", ") + ")"
+	}
+	return text
+}
+
+// MatrixNotifier posts to a Synapse room using the existing m.room.message shape
+type MatrixNotifier struct {
+	conf *Config
+}
+
+func (n *MatrixNotifier) Name() string { return BackendMatrix }
+
+func (n *MatrixNotifier) Send(ctx context.Context, text string, refs []string, routingKey string) error {
+	room := routingKey
+	if room == "" {
+		room = n.conf.room
+	}
+	url := getMatrixPost(n.conf, room)
+	val := formatRefs(html.EscapeString(text), refs)
+	m := make(map[string]string)
+	m["msgtype"] = "m.text"
+	m["body"] = BodyStart
+	m["format"] = "org.matrix.custom.html"
+	m["formatted_body"] = fmt.Sprintf(Body, val)
+	return postJSONBody(ctx, n.conf, url, m)
+}
+
+// SlackNotifier posts to a Slack incoming webhook using the blocks format
+type SlackNotifier struct {
+	webhook string
+	conf    *Config
+}
+
+func (n *SlackNotifier) Name() string { return BackendSlack }
+
+func (n *SlackNotifier) Send(ctx context.Context, text string, refs []string, routingKey string) error {
+	payload := map[string]interface{}{
+		"blocks": []map[string]interface{}{
+			{
+				"type": "section",
+				"text": map[string]string{
+					"type": "mrkdwn",
+					"text": formatRefs(text, refs),
+				},
+			},
+		},
+	}
+	return postJSONBody(ctx, n.conf, n.webhook, payload)
+}
+
+// TeamsNotifier posts to a MS Teams incoming webhook using the MessageCard format
+type TeamsNotifier struct {
+	webhook string
+	conf    *Config
+}
+
+func (n *TeamsNotifier) Name() string { return BackendTeams }
+
+func (n *TeamsNotifier) Send(ctx context.Context, text string, refs []string, routingKey string) error {
+	payload := map[string]interface{}{
+		"@type":    "MessageCard",
+		"@context": "http://schema.org/extensions",
+		"summary":  text,
+		"text":     formatRefs(text, refs),
+	}
+	return postJSONBody(ctx, n.conf, n.webhook, payload)
+}
+
+// WebhookNotifier posts a plain templated JSON body to a generic webhook URL
+type WebhookNotifier struct {
+	url  string
+	conf *Config
+}
+
+func (n *WebhookNotifier) Name() string { return BackendWebhook }
+
+func (n *WebhookNotifier) Send(ctx context.Context, text string, refs []string, routingKey string) error {
+	payload := map[string]interface{}{
+		"text":       text,
+		"refs":       refs,
+		"routingKey": routingKey,
+	}
+	return postJSONBody(ctx, n.conf, n.url, payload)
+}
+
+// DiscordNotifier posts to a Discord incoming webhook
+type DiscordNotifier struct {
+	webhook string
+	conf    *Config
+}
+
+func (n *DiscordNotifier) Name() string { return BackendDiscord }
+
+func (n *DiscordNotifier) Send(ctx context.Context, text string, refs []string, routingKey string) error {
+	payload := map[string]interface{}{
+		"content": formatRefs(text, refs),
+	}
+	return postJSONBody(ctx, n.conf, n.webhook, payload)
+}
+
+// MattermostNotifier posts to a Mattermost incoming webhook
+type MattermostNotifier struct {
+	webhook string
+	conf    *Config
+}
+
+func (n *MattermostNotifier) Name() string { return BackendMattermost }
+
+func (n *MattermostNotifier) Send(ctx context.Context, text string, refs []string, routingKey string) error {
+	payload := map[string]interface{}{
+		"text": formatRefs(text, refs),
+	}
+	if routingKey != "" {
+		payload["channel"] = routingKey
+	}
+	return postJSONBody(ctx, n.conf, n.webhook, payload)
+}
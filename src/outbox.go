@@ -0,0 +1,180 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * On-disk outbox for stories that failed chat delivery after every retry
+ */
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outboxEntry is one story that failed delivery to one or more notifier
+// backends and needs redelivering to just those (Notifiers holds the
+// Notifier.Name() of each backend still owed a delivery).
+type outboxEntry struct {
+	Text       string   `json:"text"`
+	Refs       []string `json:"refs"`
+	RoutingKey string   `json:"routingKey"`
+	Notifiers  []string `json:"notifiers"`
+	// id identifies this entry within a single process's lifetime, so Drain
+	// can tell which in-flight entry a send result belongs to without
+	// relying on slice position (which a concurrent Push can shift)
+	id uint64
+}
+
+var outboxNextID uint64
+
+func nextOutboxID() uint64 {
+	return atomic.AddUint64(&outboxNextID, 1)
+}
+
+// Outbox holds stories that failed delivery after every retry, so they can
+// be redelivered once the chat backend recovers rather than lost on the
+// floor. pending is the single source of truth; every mutation rewrites the
+// mirrored file in full, so whether an entry leaves pending via Replay or
+// via a later background Drain, it's compacted out of the file the same
+// way and a later restart never redelivers (and duplicate-posts) it.
+type Outbox struct {
+	mu        sync.Mutex
+	path      string
+	max       int
+	pending   []outboxEntry
+	lastError string
+}
+
+// NewOutbox points an outbox at outbox.jsonl under dir, bounding the
+// in-memory (and mirrored) pending set to max entries
+func NewOutbox(dir string, max int) *Outbox {
+	return &Outbox{path: path.Join(dir, "outbox.jsonl"), max: max}
+}
+
+// Push records a delivery failure: appends the entry to the pending set,
+// dropping the oldest entry once over max, and persists the new set
+func (o *Outbox) Push(e outboxEntry, failure error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if failure != nil {
+		o.lastError = failure.Error()
+	}
+	e.id = nextOutboxID()
+	o.pending = append(o.pending, e)
+	if o.max > 0 && len(o.pending) > o.max {
+		o.pending = o.pending[len(o.pending)-o.max:]
+	}
+	o.persistLocked()
+}
+
+// persistLocked rewrites the mirrored file to hold exactly the current
+// pending set. Must be called with mu held.
+func (o *Outbox) persistLocked() {
+	var buf []byte
+	for _, e := range o.pending {
+		b, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		buf = append(buf, b...)
+		buf = append(buf, '\n')
+	}
+	os.WriteFile(o.path, buf, 0644)
+}
+
+// Replay reads every entry persisted from a prior run and retries delivery
+// via send, seeding pending with whichever still fail (updated to whichever
+// of their notifiers are still failing) so the file ends up holding only
+// the entries, and backends, still undelivered
+func (o *Outbox) Replay(send func(outboxEntry) (outboxEntry, error)) {
+	data, err := os.ReadFile(o.path)
+	if err != nil {
+		return
+	}
+	var remaining []outboxEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		var e outboxEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			continue
+		}
+		e.id = nextOutboxID()
+		updated, err := send(e)
+		if err != nil {
+			o.mu.Lock()
+			o.lastError = err.Error()
+			o.mu.Unlock()
+			remaining = append(remaining, updated)
+		}
+	}
+	o.mu.Lock()
+	o.pending = remaining
+	o.persistLocked()
+	o.mu.Unlock()
+}
+
+// Drain retries every pending entry against send once per interval. An
+// entry that delivers successfully (to every notifier still named on it) is
+// dropped from pending; one that still fails is kept, updated to whichever
+// notifiers remain outstanding. Entries are matched back into the live
+// pending set by id rather than by position, so a Push landing mid-drain
+// (which can also evict from the front once over max) can never be
+// silently dropped or mismatched with the wrong result.
+func (o *Outbox) Drain(interval time.Duration, send func(outboxEntry) (outboxEntry, error)) {
+	for range time.Tick(interval) {
+		o.mu.Lock()
+		entries := append([]outboxEntry(nil), o.pending...)
+		o.mu.Unlock()
+		if len(entries) == 0 {
+			continue
+		}
+		delivered := make(map[uint64]bool, len(entries))
+		updates := make(map[uint64]outboxEntry, len(entries))
+		for _, e := range entries {
+			updated, err := send(e)
+			if err != nil {
+				o.mu.Lock()
+				o.lastError = err.Error()
+				o.mu.Unlock()
+				updates[e.id] = updated
+			} else {
+				delivered[e.id] = true
+			}
+		}
+		o.mu.Lock()
+		var remaining []outboxEntry
+		for _, e := range o.pending {
+			if delivered[e.id] {
+				continue
+			}
+			if updated, ok := updates[e.id]; ok {
+				remaining = append(remaining, updated)
+				continue
+			}
+			remaining = append(remaining, e)
+		}
+		o.pending = remaining
+		o.persistLocked()
+		o.mu.Unlock()
+	}
+}
+
+// Depth reports the number of entries currently pending redelivery
+func (o *Outbox) Depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// LastError reports the most recent delivery failure, for /metrics
+func (o *Outbox) LastError() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.lastError
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * Tests for outbox push/drain compaction and per-notifier redelivery
+ */
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOutboxDrainCompactsDeliveredEntries checks that an entry which
+// delivers successfully is dropped from both pending and the mirrored file,
+// not just from pending.
+func TestOutboxDrainCompactsDeliveredEntries(t *testing.T) {
+	dir := t.TempDir()
+	o := NewOutbox(dir, 10)
+	o.Push(outboxEntry{Text: "hello", Notifiers: []string{"slack"}}, nil)
+
+	go o.Drain(20*time.Millisecond, func(e outboxEntry) (outboxEntry, error) {
+		e.Notifiers = nil
+		return e, nil
+	})
+	time.Sleep(60 * time.Millisecond)
+
+	if got := o.Depth(); got != 0 {
+		t.Fatalf("expected the delivered entry to be dropped from pending, depth=%d", got)
+	}
+	data, err := os.ReadFile(dir + "/outbox.jsonl")
+	if err != nil {
+		t.Fatalf("reading outbox.jsonl: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != "" {
+		t.Fatalf("expected outbox.jsonl compacted to empty after a successful drain, got %q", data)
+	}
+}
+
+// TestOutboxDrainKeepsEntryPushedMidDrain checks that an entry pushed while
+// a drain cycle is already in flight survives the cycle instead of being
+// silently dropped by a stale index-based diff against the snapshot taken
+// at the start of the cycle.
+func TestOutboxDrainKeepsEntryPushedMidDrain(t *testing.T) {
+	dir := t.TempDir()
+	o := NewOutbox(dir, 10)
+	o.Push(outboxEntry{Text: "first", Notifiers: []string{"slack"}}, nil)
+
+	releaseSend := make(chan struct{})
+	sawFirstAttempt := make(chan struct{}, 1)
+	go o.Drain(10*time.Millisecond, func(e outboxEntry) (outboxEntry, error) {
+		if e.Text == "first" {
+			select {
+			case sawFirstAttempt <- struct{}{}:
+			default:
+			}
+			<-releaseSend
+			return e, nil
+		}
+		e.Notifiers = nil
+		return e, nil
+	})
+
+	<-sawFirstAttempt
+	o.Push(outboxEntry{Text: "second", Notifiers: []string{"matrix"}}, nil)
+	close(releaseSend)
+	time.Sleep(80 * time.Millisecond)
+
+	if got := o.Depth(); got != 0 {
+		t.Fatalf("expected both entries eventually delivered and dropped, depth=%d", got)
+	}
+}
+
+// TestNotifyOnceOnlyTargetsFailedNotifiers checks that redelivery only hits
+// the notifier(s) that originally failed for an entry, not every configured
+// notifier, so a backend that already succeeded isn't posted to twice.
+func TestNotifyOnceOnlyTargetsFailedNotifiers(t *testing.T) {
+	conf := &Config{}
+	var slackCalled, matrixCalled bool
+	conf.notifiers = []Notifier{
+		&fakeNotifier{name: "slack", send: func() error { slackCalled = true; return nil }},
+		&fakeNotifier{name: "matrix", send: func() error { matrixCalled = true; return nil }},
+	}
+	e := outboxEntry{Text: "hi", Notifiers: []string{"slack"}}
+
+	updated, err := notifyOnce(conf, e)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slackCalled {
+		t.Fatalf("expected the originally-failed slack notifier to be redelivered to")
+	}
+	if matrixCalled {
+		t.Fatalf("matrix never failed for this entry and should not have been redelivered to")
+	}
+	if len(updated.Notifiers) != 0 {
+		t.Fatalf("expected no notifiers left outstanding, got %v", updated.Notifiers)
+	}
+}
+
+// TestNotifyOnceKeepsStillFailingNotifiers checks that a notifier which
+// fails again on redelivery is kept on the returned entry, so it isn't
+// dropped from the outbox before it actually succeeds.
+func TestNotifyOnceKeepsStillFailingNotifiers(t *testing.T) {
+	conf := &Config{logger: NewLogger("", t.TempDir(), LevelError)}
+	conf.notifiers = []Notifier{
+		&fakeNotifier{name: "slack", send: func() error { return errBoom }},
+	}
+	e := outboxEntry{Text: "hi", Notifiers: []string{"slack"}}
+
+	updated, err := notifyOnce(conf, e)
+	if err == nil {
+		t.Fatalf("expected the still-failing notifier's error to be returned")
+	}
+	if len(updated.Notifiers) != 1 || updated.Notifiers[0] != "slack" {
+		t.Fatalf("expected slack to remain outstanding, got %v", updated.Notifiers)
+	}
+}
+
+type fakeNotifier struct {
+	name string
+	send func() error
+}
+
+func (f *fakeNotifier) Name() string { return f.name }
+
+func (f *fakeNotifier) Send(ctx context.Context, text string, refs []string, routingKey string) error {
+	return f.send()
+}
+
+var errBoom = &fakeError{"boom"}
+
+type fakeError struct{ msg string }
+
+func (e *fakeError) Error() string { return e.msg }
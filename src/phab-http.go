@@ -7,16 +7,14 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/epiphyte/goutils"
 	"html"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -32,16 +30,48 @@ const (
 	BodyEnd   = "</body>"
 	Body      = BodyStart + "%s" + BodyEnd
 	// Environment keys
-	SynapseKey  = "SYNAPSE_"
-	PhabUrlKey  = SynapseKey + "PHAB_URL"
-	ApiTokenKey = SynapseKey + "API_TOKEN"
-	FeedRoomKey = SynapseKey + "FEED_ROOM"
-	HostKey     = SynapseKey + "HOST"
-	DebugKey    = SynapseKey + "FEED_DEBUG"
-	ConduitKey  = SynapseKey + "PHAB_TOKEN"
-	ResolveKey  = SynapseKey + "FEED_PHIDS"
-	LookupsKey  = SynapseKey + "LOOKUP_PHID"
-	LogFileDir  = SynapseKey + "FEED_LOG"
+	SynapseKey   = "SYNAPSE_"
+	PhabUrlKey   = SynapseKey + "PHAB_URL"
+	ApiTokenKey  = SynapseKey + "API_TOKEN"
+	FeedRoomKey  = SynapseKey + "FEED_ROOM"
+	HostKey      = SynapseKey + "HOST"
+	DebugKey     = SynapseKey + "FEED_DEBUG"
+	ConduitKey   = SynapseKey + "PHAB_TOKEN"
+	ResolveKey   = SynapseKey + "FEED_PHIDS"
+	LookupsKey   = SynapseKey + "LOOKUP_PHID"
+	LogFileDir   = SynapseKey + "FEED_LOG"
+	LogConfigKey = SynapseKey + "LOG_CONFIG"
+	LogLevelKey  = SynapseKey + "LOG_LEVEL"
+	// Notifier backend selection and per-backend config
+	BackendsKey          = SynapseKey + "BACKENDS"
+	SlackWebhookKey      = SynapseKey + "SLACK_WEBHOOK"
+	TeamsWebhookKey      = SynapseKey + "TEAMS_WEBHOOK"
+	WebhookUrlKey        = SynapseKey + "WEBHOOK_URL"
+	DiscordWebhookKey    = SynapseKey + "DISCORD_WEBHOOK"
+	MattermostWebhookKey = SynapseKey + "MATTERMOST_WEBHOOK"
+	// PHID cache tuning, in seconds
+	CacheTTLKey          = SynapseKey + "CACHE_TTL"
+	CacheMaxKey          = SynapseKey + "CACHE_MAX"
+	CacheNegativeTTLKey  = SynapseKey + "CACHE_NEGATIVE_TTL"
+	CacheRefreshAheadKey = SynapseKey + "CACHE_REFRESH_AHEAD"
+	// Defaults applied when the cache env vars are unset
+	DefaultCacheTTL          = 3600
+	DefaultCacheMax          = 10000
+	DefaultCacheNegativeTTL  = 60
+	DefaultCacheRefreshAhead = 60
+	// HTTP client tuning, in seconds / attempt count
+	HTTPTimeoutKey     = SynapseKey + "HTTP_TIMEOUT"
+	HTTPRetriesKey     = SynapseKey + "HTTP_RETRIES"
+	DefaultHTTPTimeout = 10
+	DefaultHTTPRetries = 3
+	// Graceful shutdown grace period, in seconds
+	ShutdownGraceKey     = SynapseKey + "SHUTDOWN_GRACE"
+	DefaultShutdownGrace = 30
+	// Outbox tuning: max queued redeliveries and the drain interval, in seconds
+	OutboxMaxKey           = SynapseKey + "OUTBOX_MAX"
+	OutboxDrainIntervalKey = SynapseKey + "OUTBOX_DRAIN_INTERVAL"
+	DefaultOutboxMax       = 1000
+	DefaultOutboxDrain     = 30
 	// PHID types
 	IsPHIDType = "PHID-"
 	// JSON keys
@@ -56,23 +86,24 @@ const (
 
 // Input configuration
 type Config struct {
-	phids     string
-	room      string
-	debug     bool
-	conduit   string
-	resolving []string
-	lookups   map[string]string
-	cache     *sync.Map
-	paste     string
-	logger    *Logging
-	logDir    string
-	url       string
-	token     string
-}
-
-// Logging object
-type Logging struct {
-	sync.RWMutex
+	phids       string
+	room        string
+	roomRoutes  map[string]string
+	debug       bool
+	conduit     string
+	resolving   []string
+	lookups     map[string]string
+	cache       *TTLCache
+	paste       string
+	logger      *Logger
+	logDir      string
+	url         string
+	token       string
+	notifiers   []Notifier
+	httpClient  *http.Client
+	httpRetries int
+	outbox      *Outbox
+	shutdown    func()
 }
 
 // Build a query string for key/value pair
@@ -80,45 +111,37 @@ func buildQuery(key string, value string) string {
 	return fmt.Sprintf("%s=%s", key, value)
 }
 
+// envInt reads an integer environment variable, falling back to def when
+// unset or unparseable
+func envInt(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	val, err := strconv.Atoi(raw)
+	if err != nil {
+		return def
+	}
+	return val
+}
+
 // Write log data
 func writeLog(category string, message string, conf *Config) {
-	writeRawLog(category, message, conf, "")
+	conf.logger.Info(category, message)
 }
 
 // write an error out
 func writeError(message string, err error, conf *Config) {
 	if err != nil {
-		goutils.WriteError(message, err)
+		conf.logger.Error(message, err)
 	} else {
-		goutils.WriteWarn(message)
+		conf.logger.Warn(message)
 	}
-	go writeLogError(message, conf)
-}
-
-// write to file
-func writeLogError(message string, conf *Config) {
-	t := time.Now()
-	category := t.Format("2006-01-02 15:04:05") + " [ERROR] "
-	writeRawLog(category, message, conf, "error.")
 }
 
-// write raw logs
-func writeRawLog(category string, message string, conf *Config, prefix string) {
-	conf.logger.Lock()
-	defer conf.logger.Unlock()
-	t := time.Now()
-	logFile := prefix + "phab-http." + t.Format("2006-01-02") + ".log"
-	f, err := os.OpenFile(path.Join(conf.logDir, logFile), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		goutils.WriteError("unable to access log", err)
-		return
-	}
-	defer f.Close()
-	fmt.Fprintf(f, "%s -> %s\n", category, message)
-}
-
-// Post with a form body
-func postBody(data map[string]string, url string, conf *Config) []byte {
+// Post with a form body, bounded by ctx so a request's deadline (or the
+// server's shutdown) aborts any Conduit call still in flight
+func postBody(ctx context.Context, data map[string]string, url string, conf *Config) []byte {
 	var results []byte
 	var datum []string
 	datum = append(datum, buildQuery("api.token", conf.conduit))
@@ -126,52 +149,87 @@ func postBody(data map[string]string, url string, conf *Config) []byte {
 		datum = append(datum, buildQuery(k, v))
 	}
 	var queryString = strings.Join(datum, "&")
-	body := strings.NewReader(queryString)
-	req, err := http.NewRequest("POST", url, body)
+	req, err := http.NewRequest("POST", url, strings.NewReader(queryString))
 	if err != nil {
 		writeError("requesting", err, conf)
-	} else {
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			writeError("go", err, conf)
-		} else {
-			results, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
-				writeError("query", err, conf)
-			} else {
-				defer resp.Body.Close()
-			}
-		}
+		return results
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(queryString)), nil
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx, cancel := context.WithTimeout(ctx, conf.httpClient.Timeout)
+	defer cancel()
+	resp, err := doWithRetry(ctx, conf.httpClient, req, conf.httpRetries)
+	if err != nil {
+		writeError("go", err, conf)
+		return results
+	}
+	defer resp.Body.Close()
+	results, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		writeError("query", err, conf)
 	}
 	return results
 }
 
-// POST JSON data
-func postJSON(data map[string]string, url string, conf *Config) {
-	b, err := json.Marshal(data)
-	if err != nil {
-		writeError("json", err, conf)
-		return
+// Dispatch a story to every configured notifier backend concurrently,
+// bounded by ctx so a server shutdown aborts any post still in flight.
+// Whichever backends still fail after their own retries are recorded by
+// name on a single outbox entry, so a later redelivery only replays to
+// those backends instead of re-posting to ones that already succeeded.
+func notify(ctx context.Context, conf *Config, text string, refs []string, routingKey string) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for _, n := range conf.notifiers {
+		wg.Add(1)
+		go func(n Notifier) {
+			defer wg.Done()
+			if err := n.Send(ctx, text, refs, routingKey); err != nil {
+				writeError("notify", err, conf)
+				mu.Lock()
+				failed = append(failed, n.Name())
+				mu.Unlock()
+			}
+		}(n)
 	}
-	_, err = http.Post(url, "application/json", bytes.NewReader(b))
-	if err != nil {
-		writeError("req", err, conf)
+	wg.Wait()
+	if len(failed) > 0 && conf.outbox != nil {
+		conf.outbox.Push(outboxEntry{Text: text, Refs: refs, RoutingKey: routingKey, Notifiers: failed},
+			fmt.Errorf("delivery failed for: %s", strings.Join(failed, ", ")))
 	}
 }
 
-// Execute an actual posting to the synapse endpoint
-func execute(text string, url string, conf *Config, phids []string) {
-	m := make(map[string]string)
-	m["msgtype"] = "m.text"
-	m["body"] = BodyStart
-	m["format"] = "org.matrix.custom.html"
-	val := html.EscapeString(text)
-	if len(phids) > 0 {
-		val = val + "<br /> (references: " + strings.Join(phids, ", ") + ")"
+// notifyOnce redelivers a single outbox entry to only the notifiers named
+// in e.Notifiers (not every configured one), used by startup replay and
+// the background drain loop. It returns e updated to whichever of those
+// backends are still failing and the last error hit, so the caller can
+// tell whether (and to what) the entry still needs to be kept pending.
+func notifyOnce(conf *Config, e outboxEntry) (outboxEntry, error) {
+	var stillFailing []string
+	var last error
+	for _, n := range conf.notifiers {
+		if !containsName(e.Notifiers, n.Name()) {
+			continue
+		}
+		if err := n.Send(context.Background(), e.Text, e.Refs, e.RoutingKey); err != nil {
+			writeError("notify retry", err, conf)
+			stillFailing = append(stillFailing, n.Name())
+			last = err
+		}
 	}
-	m["formatted_body"] = fmt.Sprintf(Body, val)
-	postJSON(m, url, conf)
+	e.Notifiers = stillFailing
+	return e, last
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
 
 // Check if a string represents a phid
@@ -212,7 +270,7 @@ func digJSONOut(obj []byte, description string, conf *Config, dig []string) (boo
 	if valid {
 		if len(dig) > 0 {
 			if conf.debug {
-				goutils.WriteDebug("deeper", dig...)
+				conf.logger.Debug("deeper", dig...)
 			}
 			var sub []string
 			if len(dig) > 1 {
@@ -227,7 +285,7 @@ func digJSONOut(obj []byte, description string, conf *Config, dig []string) (boo
 		}
 	}
 	if !valid {
-		goutils.WriteInfo("unable to dig out, see ^^^")
+		conf.logger.Info("unable to dig out, see ^^^")
 	}
 	return valid, res
 }
@@ -239,7 +297,7 @@ func initLookups(conf *Config, phid string) map[string]string {
 	m["attachments[content]"] = "1"
 	m["constraints[phids][0]"] = phid
 	lookups := make(map[string]string)
-	obj := postBody(m, conf.paste, conf)
+	obj := postBody(context.Background(), m, conf.paste, conf)
 	valid, output := getJSON(obj, "PHIDs", true, conf)
 	if valid {
 		valid, res := getJSON(output[ResultJSON], "Results", false, conf)
@@ -261,7 +319,7 @@ func initLookups(conf *Config, phid string) map[string]string {
 							if err != nil {
 								writeError("invalid paste json", err, conf)
 							} else {
-								goutils.WriteDebug("lookups resolved")
+								conf.logger.Debug("lookups resolved")
 							}
 						}
 					}
@@ -279,60 +337,89 @@ func getMatrixPost(conf *Config, room string) string {
 	return fmt.Sprintf(MatrixPost, conf.url, room, conf.token)
 }
 
-// Resolve phids
-func resolvePHIDs(resolving []string, conf *Config) []string {
+// queryPHIDs calls phid.query for the given ids and stores each result in
+// the cache, keyed by phid
+func queryPHIDs(ctx context.Context, conf *Config, phids []string) {
+	if len(phids) == 0 {
+		return
+	}
+	m := make(map[string]string)
+	var idx int = 0
+	for _, element := range phids {
+		m["phids["+strconv.Itoa(idx)+"]"] = element
+		idx++
+	}
+	obj := postBody(ctx, m, conf.phids, conf)
+	valid, output := getJSON(obj, "PHIDs", true, conf)
+	if !valid {
+		return
+	}
+	valid, res := getJSON(output[ResultJSON], "Results", false, conf)
+	if !valid {
+		return
+	}
+	for _, v := range res {
+		var final map[string]string
+		err := json.Unmarshal(v, &final)
+		if err != nil {
+			writeError("object", err, conf)
+			continue
+		}
+		var name string = final["name"]
+		var uri string = final["uri"]
+		var resolved []string
+
+		resolved = append(resolved, "<a href='"+uri+"'>"+html.EscapeString(name)+"</a>")
+		if val, ok := conf.lookups[name]; ok {
+			resolved = append(resolved, "aka: "+strings.Replace(val, ",", " ", -1))
+		}
+		conf.cache.Store(final["phid"], resolved)
+	}
+	// phid.query omits ids it couldn't find entirely; negative-cache those
+	// so a bad/renamed PHID isn't re-queried on every request
+	for _, phid := range phids {
+		if _, ok := res[phid]; !ok {
+			conf.cache.StoreNegative(phid)
+		}
+	}
+}
+
+// refreshPHID re-resolves a single phid for the cache's background
+// refresher, which runs on its own timer rather than a request deadline
+func refreshPHID(conf *Config, phid string) ([]string, bool) {
+	queryPHIDs(context.Background(), conf, []string{phid})
+	return conf.cache.Load(phid)
+}
+
+// Resolve phids, bounded by ctx so a slow Conduit lookup can't outlive the
+// hook request (or the server's shutdown grace period)
+func resolvePHIDs(ctx context.Context, resolving []string, conf *Config) []string {
 	var phids []string
 	for _, element := range resolving {
 		if conf.debug {
-			goutils.WriteDebug(element)
+			conf.logger.Debug(element)
 		}
 		if _, ok := conf.cache.Load(element); !ok {
 			if conf.debug {
-				goutils.WriteDebug("resolving...")
+				conf.logger.Debug("resolving...")
 			}
 			phids = append(phids, element)
 		}
 	}
 	if len(phids) > 0 {
 		if conf.debug {
-			goutils.WriteDebug("calling to resolve phids")
-		}
-		m := make(map[string]string)
-		var idx int = 0
-		for _, element := range phids {
-			m["phids["+strconv.Itoa(idx)+"]"] = element
-			idx++
-		}
-		obj := postBody(m, conf.phids, conf)
-		valid, output := getJSON(obj, "PHIDs", true, conf)
-		if valid {
-			valid, res := getJSON(output[ResultJSON], "Results", false, conf)
-			if valid {
-				for _, v := range res {
-					var final map[string]string
-					err := json.Unmarshal(v, &final)
-					if err != nil {
-						writeError("object", err, conf)
-						continue
-					}
-					var name string = final["name"]
-					var uri string = final["uri"]
-					var resolved []string
-
-					resolved = append(resolved, "<a href='"+uri+"'>"+html.EscapeString(name)+"</a>")
-					if val, ok := conf.lookups[name]; ok {
-						resolved = append(resolved, "aka: "+strings.Replace(val, ",", " ", -1))
-					}
-					conf.cache.Store(final["phid"], resolved)
-				}
-			}
+			conf.logger.Debug("calling to resolve phids")
 		}
+		// Coalesce across concurrent hook deliveries: a PHID another
+		// request is already resolving is waited on instead of re-queried
+		conf.cache.CoalesceBatch(phids, func(claimed []string) {
+			queryPHIDs(ctx, conf, claimed)
+		})
 	}
 	var results []string
 	for _, element := range resolving {
 		var writeRefs []string
-		if inter, ok := conf.cache.Load(element); ok {
-			val := inter.([]string)
+		if val, ok := conf.cache.Load(element); ok {
 			for _, item := range val {
 				writeRefs = append(writeRefs, item)
 				results = append(results, item)
@@ -350,6 +437,7 @@ func resolvePHIDs(resolving []string, conf *Config) []string {
 
 // Called when phabricator fires into the hook
 func postStory(w http.ResponseWriter, r *http.Request, conf *Config) {
+	ctx := r.Context()
 	r.ParseForm()
 	var isStory bool = false
 	var phids []string
@@ -359,7 +447,7 @@ func postStory(w http.ResponseWriter, r *http.Request, conf *Config) {
 	var isTagged bool = false
 	for k, v := range r.Form {
 		if conf.debug {
-			goutils.WriteDebug("kv: "+k, v...)
+			conf.logger.Debug("kv: "+k, v...)
 		}
 		if len(v) > 0 {
 			if k == "storyText" {
@@ -371,7 +459,7 @@ func postStory(w http.ResponseWriter, r *http.Request, conf *Config) {
 				for _, element := range v {
 					if isPHID(element, conf.resolving) {
 						if conf.debug {
-							goutils.WriteDebug("phid:", element)
+							conf.logger.Debug("phid:", element)
 						}
 						phids = append(phids, element)
 					} else {
@@ -389,9 +477,9 @@ func postStory(w http.ResponseWriter, r *http.Request, conf *Config) {
 				phids = phids[:0]
 			} else {
 				if conf.debug {
-					goutils.WriteDebug("resolving phids")
+					conf.logger.Debug("resolving phids")
 				}
-				phids = resolvePHIDs(phids, conf)
+				phids = resolvePHIDs(ctx, phids, conf)
 			}
 		}
 		var addedStory string
@@ -399,7 +487,7 @@ func postStory(w http.ResponseWriter, r *http.Request, conf *Config) {
 		storyText := strings.Join(story, "")
 		if isTagged {
 			if conf.debug {
-				goutils.WriteDebug("story", storyText, toRoom)
+				conf.logger.Debug("story", storyText, toRoom)
 			}
 			var output map[string]string
 			err := json.Unmarshal([]byte(storyText), &output)
@@ -415,7 +503,11 @@ func postStory(w http.ResponseWriter, r *http.Request, conf *Config) {
 					} else {
 						if k == IsTitle {
 							isValid = true
-							toRoom = getMatrixPost(conf, tagged)
+							if target, ok := conf.roomRoutes[tagged]; ok {
+								toRoom = target
+							} else {
+								toRoom = tagged
+							}
 							storyText = v
 						} else {
 							addedStory = fmt.Sprintf("%s (%s -> %s)", addedStory, k, v)
@@ -432,75 +524,135 @@ func postStory(w http.ResponseWriter, r *http.Request, conf *Config) {
 			}
 		}
 		if conf.debug {
-			goutils.WriteDebug("routing", storyText, toRoom)
+			conf.logger.Debug("routing", storyText, toRoom)
 			if isTagged {
-				goutils.WriteDebug("tagged")
+				conf.logger.Debug("tagged")
 			}
 		}
-		execute(storyText, toRoom, conf, phids)
+		notify(ctx, conf, storyText, phids, toRoom)
 	}
 }
 
-// main-entry point
-func main() {
-	vers := fmt.Sprintf("version: %s", Version)
-	goutils.WriteInfo(fmt.Sprintf("Starting phab-http receiving hook (%s)", vers))
+// buildConfig assembles a Config from settings already merged from flags,
+// -config and the environment by the cli layer; callers are expected to
+// have run validateSettings first, so required fields are assumed present
+// here. When live is false (the resolve debug helper), every operation
+// with a real-world side effect beyond the PHID lookup itself is skipped:
+// no Conduit paste lookup for aliases, and no outbox replay/drain, so a
+// one-off "resolve a PHID" invocation can't re-post previously-failed
+// notifications to real chat backends.
+func buildConfig(s *cliSettings, live bool) *Config {
 	conf := new(Config)
-	url := os.Getenv(PhabUrlKey) + "api/"
+	conf.logDir = s.logDir
+	conf.logger = NewLogger(s.logConfig, conf.logDir, parseLevel(s.logLevel))
+	conf.logger.Info(fmt.Sprintf("Starting phab-http receiving hook (version: %s)", Version))
+	url := s.phabURL + "api/"
 	conf.phids = url + "phid.query"
-	matrix := os.Getenv(HostKey)
-	token := os.Getenv(ApiTokenKey)
-	room := os.Getenv(FeedRoomKey)
 	conf.paste = url + "paste.search"
-	conf.conduit = os.Getenv(ConduitKey)
-	conf.resolving = strings.Split(os.Getenv(ResolveKey), ",")
-	conf.url = matrix
-	conf.token = token
-	conf.room = getMatrixPost(conf, room)
-	conf.logDir = os.Getenv(LogFileDir)
-	conf.logger = &Logging{}
-	lookups := os.Getenv(LookupsKey)
-	conf.cache = new(sync.Map)
-	debug, err := strconv.ParseBool(os.Getenv(DebugKey))
+	conf.conduit = s.conduitToken
+	conf.resolving = strings.Split(s.resolve, ",")
+	conf.url = s.host
+	conf.token = s.apiToken
+	conf.room = s.feedRoom
+	conf.roomRoutes = s.roomRoutes
+	httpTimeout := time.Duration(envInt(HTTPTimeoutKey, DefaultHTTPTimeout)) * time.Second
+	conf.httpClient = newHTTPClient(httpTimeout)
+	conf.httpRetries = envInt(HTTPRetriesKey, DefaultHTTPRetries)
+	ttl := time.Duration(envInt(CacheTTLKey, DefaultCacheTTL)) * time.Second
+	negativeTTL := time.Duration(envInt(CacheNegativeTTLKey, DefaultCacheNegativeTTL)) * time.Second
+	refreshAhead := time.Duration(envInt(CacheRefreshAheadKey, DefaultCacheRefreshAhead)) * time.Second
+	conf.cache = NewTTLCache(envInt(CacheMaxKey, DefaultCacheMax), ttl, negativeTTL, refreshAhead, func(phid string) ([]string, bool) {
+		return refreshPHID(conf, phid)
+	})
+	debug, err := strconv.ParseBool(s.debug)
 	if err != nil {
-		goutils.WriteError("unable to determine debug setting", err)
+		conf.logger.Error("unable to determine debug setting", err)
 		conf.debug = false
 	} else {
 		conf.debug = debug
 	}
-	goutils.ConfigureLogging(conf.debug, true, true, true, false)
 	if conf.debug {
-		goutils.WriteDebug("debug on")
-		goutils.WriteDebug("phids", conf.phids)
-		goutils.WriteDebug("resolving", conf.resolving...)
-		goutils.WriteDebug("api", conf.conduit, conf.url, conf.token, conf.room, conf.paste)
-		goutils.WriteDebug("lookups")
-		for k, v := range lookups {
-			goutils.WriteDebug(strconv.Itoa(k), string(v))
-		}
-		goutils.WriteDebug("logging", conf.logDir)
-		goutils.WriteDebug("init lookups...")
+		conf.logger.Debug("debug on")
+		conf.logger.Debug("phids", conf.phids)
+		conf.logger.Debug("resolving", conf.resolving...)
+		conf.logger.Debug("api", conf.conduit, conf.url, conf.token, conf.room, conf.paste)
+		conf.logger.Debug("logging", conf.logDir)
 	}
-	conf.lookups = initLookups(conf, lookups)
-	if conf.debug {
-		goutils.WriteDebug("lookups ready")
-		for k, v := range conf.lookups {
-			goutils.WriteDebug(k, string(v))
+	conf.lookups = make(map[string]string)
+	if live {
+		if conf.debug {
+			conf.logger.Debug("init lookups...")
 		}
+		conf.lookups = initLookups(conf, s.lookupPhid)
+		if conf.debug {
+			conf.logger.Debug("lookups ready")
+			for k, v := range conf.lookups {
+				conf.logger.Debug(k, string(v))
+			}
+		}
+	}
+	conf.notifiers = buildNotifiers(conf)
+	conf.outbox = NewOutbox(conf.logDir, envInt(OutboxMaxKey, DefaultOutboxMax))
+	if live {
+		conf.outbox.Replay(func(e outboxEntry) (outboxEntry, error) {
+			return notifyOnce(conf, e)
+		})
+		drainInterval := time.Duration(envInt(OutboxDrainIntervalKey, DefaultOutboxDrain)) * time.Second
+		go conf.outbox.Drain(drainInterval, func(e outboxEntry) (outboxEntry, error) {
+			return notifyOnce(conf, e)
+		})
 	}
 	writeLog("startup", "started", conf)
+	return conf
+}
+
+// registerHandlers wires up every HTTP route against conf
+func registerHandlers(conf *Config, vers string) {
 	http.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, vers)
 	})
 	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
-		os.Exit(0)
+		io.WriteString(w, "shutting down")
+		conf.shutdown()
+	})
+	http.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		b, err := json.Marshal(conf.cache.Snapshot())
+		if err != nil {
+			writeError("cache snapshot", err, conf)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	})
+	http.HandleFunc("/cache/flush", func(w http.ResponseWriter, r *http.Request) {
+		conf.cache.Flush()
+		io.WriteString(w, "flushed")
+	})
+	// /cache/purge is the current name for this admin action; /cache/flush
+	// is kept as-is for deployments that already call it
+	http.HandleFunc("/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		conf.cache.Flush()
+		io.WriteString(w, "purged")
+	})
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		hits, misses := conf.cache.Stats()
+		b, err := json.Marshal(map[string]interface{}{
+			"outboxDepth":     conf.outbox.Depth(),
+			"outboxLastError": conf.outbox.LastError(),
+			"cacheSize":       conf.cache.Len(),
+			"cacheHits":       hits,
+			"cacheMisses":     misses,
+		})
+		if err != nil {
+			writeError("metrics", err, conf)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
 	})
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		postStory(w, r, conf)
 	})
-	goutils.WriteInfo("started")
-	listen := http.ListenAndServe(":8080", nil)
-	if listen != nil {
-		goutils.WriteError("listen failure", listen)
-	}
 }
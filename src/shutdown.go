@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017
+ * MIT License
+ * Graceful shutdown and zero-downtime (SIGHUP) restart for the HTTP server
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ListenFDEnv carries the inherited listening socket's fd across a hot restart
+const ListenFDEnv = "SYNAPSE_LISTEN_FD"
+
+// serve binds addr (or reuses a socket inherited via ListenFDEnv), then
+// blocks until SIGTERM/SIGINT, the /shutdown endpoint, or SIGHUP fires.
+// SIGHUP forks a child that inherits the listening socket before this
+// process drains and exits, so no Phabricator hook delivery is dropped.
+func serve(conf *Config, addr string, grace time.Duration) error {
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: addr}
+	shutdownCh := make(chan struct{})
+	conf.shutdown = func() {
+		select {
+		case <-shutdownCh:
+		default:
+			close(shutdownCh)
+		}
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			conf.logger.Error("listen failure", err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	// A failed hot restart must not fall through to the shutdown below: the
+	// whole point of SIGHUP is a zero-downtime handoff, so if no replacement
+	// process ever got spun up, this one keeps serving instead of taking the
+	// service down for nothing.
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				if err := hotRestart(listener); err != nil {
+					conf.logger.Error("hot restart failed, continuing to serve", err)
+					continue
+				}
+			}
+		case <-shutdownCh:
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	conf.logger.Flush()
+	return err
+}
+
+// listen binds addr, or reuses the socket inherited from a hot-restarting parent
+func listen(addr string) (net.Listener, error) {
+	if raw := os.Getenv(ListenFDEnv); raw != "" {
+		fd, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, err
+		}
+		file := os.NewFile(uintptr(fd), "listener")
+		return net.FileListener(file)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// hotRestart forks a replacement process that inherits listener's socket via
+// ExtraFiles, so the new process can start accepting before this one exits
+func hotRestart(listener net.Listener) error {
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("listener does not support hot restart")
+	}
+	file, err := tcpListener.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	execPath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), ListenFDEnv+"=3")
+	_, err = os.StartProcess(execPath, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, file},
+	})
+	return err
+}